@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// AuthContext carries the outcome of the authentication sub-negotiation
+// (see Authenticator) through to a Backend's Dial/DialContext, so that
+// backends can make per-user decisions (routing, ACLs, accounting, ...).
+type AuthContext struct {
+	// Method is the authentication method that was used, one of the
+	// method constants (NO_AUTH_REQUIRED, USERNAME_PASSWORD, ...).
+	Method byte
+
+	// Payload carries method-specific data about the authenticated
+	// client. UserPassAuthenticator sets "username".
+	Payload map[string]string
+}
+
+// Authenticator implements one of the socks5 authentication methods
+// (RFC 1928 section 3). Method returns the identifier to advertise
+// during method negotiation; Authenticate performs the sub-negotiation
+// once that method has been selected and returns the resulting
+// AuthContext.
+type Authenticator interface {
+	Method() byte
+	Authenticate(conn net.Conn) (AuthContext, error)
+}
+
+// AuthenticatorProvider is implemented by Backends that want to offer
+// something other than NO_AUTH_REQUIRED. If a Backend doesn't implement
+// it (or returns an empty slice), authConn falls back to the original
+// behavior of only accepting NO_AUTH_REQUIRED.
+type AuthenticatorProvider interface {
+	Authenticators() []Authenticator
+}
+
+// CredentialStore validates a username/password pair, as used by
+// UserPassAuthenticator.
+type CredentialStore interface {
+	Valid(user, pass string) bool
+}
+
+// StaticCredentials is a CredentialStore backed by a fixed map of
+// username to password.
+type StaticCredentials map[string]string
+
+// Valid reports whether pass is the password on file for user.
+func (s StaticCredentials) Valid(user, pass string) bool {
+	want, ok := s[user]
+	return ok && want == pass
+}
+
+const (
+	userPassAuthVersion = 0x01
+	userPassAuthSuccess = 0x00
+	userPassAuthFailure = 0x01
+)
+
+// UserPassAuthenticator implements the server side of the
+// username/password authentication method defined by RFC 1929.
+type UserPassAuthenticator struct {
+	Credentials CredentialStore
+}
+
+// Method returns USERNAME_PASSWORD.
+func (a UserPassAuthenticator) Method() byte {
+	return USERNAME_PASSWORD
+}
+
+// Authenticate performs the RFC 1929 sub-negotiation, validating the
+// client-supplied username/password against a.Credentials.
+func (a UserPassAuthenticator) Authenticate(conn net.Conn) (AuthContext, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return AuthContext{}, err
+	}
+	if header[0] != userPassAuthVersion {
+		return AuthContext{}, BadVer
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return AuthContext{}, err
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return AuthContext{}, err
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return AuthContext{}, err
+	}
+
+	ok := a.Credentials != nil && a.Credentials.Valid(string(user), string(pass))
+	status := byte(userPassAuthFailure)
+	if ok {
+		status = userPassAuthSuccess
+	}
+	if _, err := conn.Write([]byte{userPassAuthVersion, status}); err != nil {
+		return AuthContext{}, err
+	}
+	if !ok {
+		return AuthContext{}, errors.New("socks5: invalid username or password")
+	}
+	return AuthContext{
+		Method:  USERNAME_PASSWORD,
+		Payload: map[string]string{"username": string(user)},
+	}, nil
+}
+
+// UserPassAuthenticate returns an AuthenticateFn (see Client.Authenticate)
+// that performs the client side of RFC 1929 username/password
+// authentication, offering user/pass.
+func UserPassAuthenticate(user, pass string) AuthenticateFn {
+	return func(ctx context.Context, conn net.Conn, method byte) error {
+		if len(user) > 255 || len(pass) > 255 {
+			return BadStr
+		}
+		req := make([]byte, 0, 3+len(user)+len(pass))
+		req = append(req, userPassAuthVersion, byte(len(user)))
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			return err
+		}
+		if status[0] != userPassAuthVersion {
+			return BadVer
+		}
+		if status[1] != userPassAuthSuccess {
+			return errors.New("socks5: invalid username or password")
+		}
+		return nil
+	}
+}
+
+type authContextKey struct{}
+
+func withAuthContext(ctx context.Context, a AuthContext) context.Context {
+	return context.WithValue(ctx, authContextKey{}, a)
+}
+
+// AuthContextFromContext extracts the AuthContext threaded through by
+// handleConn, for use by Backend implementations of ContextDialer.
+func AuthContextFromContext(ctx context.Context) (AuthContext, bool) {
+	a, ok := ctx.Value(authContextKey{}).(AuthContext)
+	return a, ok
+}
@@ -0,0 +1,331 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// AuthenticateFn performs a single authentication sub-negotiation for
+// whichever method the proxy selected out of Client.AuthMethods. It is
+// only invoked when the proxy selects a method other than
+// NO_AUTH_REQUIRED; conn is the raw connection to the proxy.
+type AuthenticateFn func(ctx context.Context, conn net.Conn, method byte) error
+
+// Client is a client for the socks5 protocol (RFC 1928): it dials a
+// socks5 proxy at ProxyAddress and asks it to relay a connection (or, for
+// BIND and UDP ASSOCIATE, a listener or packet conn) to some other
+// destination.
+//
+// Since *Client implements Dial, it also satisfies this package's Dialer
+// interface, and so can be used directly as a Backend (or as the
+// Forward of another Client) in order to chain through an upstream
+// socks5 proxy.
+//
+// The zero value offers NO_AUTH_REQUIRED and dials the proxy directly
+// with a net.Dialer; it is otherwise ready to use.
+type Client struct {
+	// ProxyNetwork and ProxyAddress identify the socks5 proxy, in the
+	// form accepted by net.Dial.
+	ProxyNetwork string
+	ProxyAddress string
+
+	// AuthMethods lists the authentication methods to offer the proxy,
+	// in preference order. A nil slice offers only NO_AUTH_REQUIRED.
+	AuthMethods []byte
+
+	// Authenticate performs the sub-negotiation for whichever method the
+	// proxy selects. It must be non-nil if AuthMethods contains
+	// anything other than NO_AUTH_REQUIRED.
+	Authenticate AuthenticateFn
+
+	// Forward dials the proxy itself. If nil, the proxy is dialed
+	// directly with a net.Dialer. This allows proxies to be chained.
+	Forward Dialer
+}
+
+// DialContext connects to addr via the proxy, using the CONNECT command,
+// and returns the resulting connection. The context governs the whole
+// handshake, including the initial connection to the proxy when Forward
+// is nil or implements DialContext.
+func (d *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, rep, err := d.handshake(ctx, REQ_CONNECT, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Code != byte(REP_SUCCESS) {
+		conn.Close()
+		return nil, ReplyCode(rep.Code)
+	}
+	return conn, nil
+}
+
+// Dial is like DialContext, with context.Background().
+func (d *Client) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// BindResult is returned by Client.Bind once the proxy has replied to the
+// initial BIND request and started listening on its end.
+type BindResult struct {
+	// Addr is the address the proxy is listening on. The caller is
+	// responsible for communicating it to the remote peer via whatever
+	// out-of-band channel the higher-level protocol provides (as, e.g.,
+	// FTP does with the PORT command).
+	Addr net.Addr
+
+	conn net.Conn
+}
+
+// Accept waits for the proxy's second reply, sent once the remote peer
+// we gave Addr to connects, and returns the resulting net.Conn.
+func (b *BindResult) Accept(ctx context.Context) (net.Conn, error) {
+	rep, err := readMsgCtx(ctx, b.conn)
+	if err != nil {
+		b.conn.Close()
+		return nil, err
+	}
+	if rep.Code != byte(REP_SUCCESS) {
+		b.conn.Close()
+		return nil, ReplyCode(rep.Code)
+	}
+	return b.conn, nil
+}
+
+// Bind asks the proxy to accept a connection on our behalf (the socks5
+// BIND command), as used by protocols like active-mode FTP.
+func (d *Client) Bind(ctx context.Context, network, addr string) (*BindResult, error) {
+	conn, rep, err := d.handshake(ctx, REQ_BIND, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Code != byte(REP_SUCCESS) {
+		conn.Close()
+		return nil, ReplyCode(rep.Code)
+	}
+	return &BindResult{Addr: replyAddr(rep), conn: conn}, nil
+}
+
+// UDPAssociate asks the proxy to relay UDP datagrams on our behalf (the
+// socks5 UDP ASSOCIATE command). The returned net.PacketConn transparently
+// adds and strips the per-datagram socks5 header; addr and network
+// identify the address the client intends to send datagrams from, and may
+// be left zero (":0") when unknown. The association lasts only as long as
+// the returned PacketConn's control connection (to the proxy) remains
+// open; closing the PacketConn closes it.
+func (d *Client) UDPAssociate(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+	ctrl, rep, err := d.handshake(ctx, REQ_UDP_ASSOCIATE, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Code != byte(REP_SUCCESS) {
+		ctrl.Close()
+		return nil, ReplyCode(rep.Code)
+	}
+	relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(
+		rep.Addr.String(), strconv.Itoa(int(rep.Port)),
+	))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return &assocPacketConn{PacketConn: pc, relayAddr: relayAddr, ctrl: ctrl}, nil
+}
+
+// assocPacketConn implements net.PacketConn over a UDP ASSOCIATE relay,
+// prepending/stripping the socks5 UDP header on each datagram.
+type assocPacketConn struct {
+	net.PacketConn
+	relayAddr net.Addr
+	ctrl      net.Conn
+}
+
+func (c *assocPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 0, err
+	}
+	hdr := udpHeader{Addr: addrFromHost(host), Port: uint16(port)}
+	var buf bytes.Buffer
+	if _, err := hdr.WriteTo(&buf); err != nil {
+		return 0, err
+	}
+	buf.Write(p)
+	if _, err := c.PacketConn.WriteTo(buf.Bytes(), c.relayAddr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *assocPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(p)+262) // max udpHeader size + payload
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		r := bytes.NewReader(buf[:n])
+		hdr := udpHeader{}
+		if _, err := hdr.ReadFrom(r); err != nil {
+			return 0, nil, err
+		}
+		if hdr.Frag != 0 {
+			// Fragmented datagrams are unsupported; drop them.
+			continue
+		}
+		from := &net.UDPAddr{IP: hdr.Addr.IPAddr, Port: int(hdr.Port)}
+		n, err = r.Read(p)
+		return n, from, err
+	}
+}
+
+func (c *assocPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.PacketConn.Close()
+}
+
+// handshake dials the proxy, negotiates authentication, and sends a
+// request for cmd/network/addr, returning the resulting connection and
+// the proxy's (first) reply.
+func (d *Client) handshake(ctx context.Context, cmd byte, network, addr string) (net.Conn, *Msg, error) {
+	destAddr, destPort, err := hostPortAddress(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closeConn := &conn
+	defer func() {
+		if closeConn != nil {
+			(*closeConn).Close()
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if ctx.Done() != nil {
+		stop := watchContext(ctx, conn)
+		defer stop()
+	}
+
+	if err := d.negotiate(ctx, conn); err != nil {
+		return nil, nil, err
+	}
+
+	req := &Msg{Code: cmd, Addr: destAddr, Port: destPort}
+	if _, err := req.WriteTo(conn); err != nil {
+		return nil, nil, err
+	}
+	rep := &Msg{}
+	if _, err := rep.ReadFrom(conn); err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	closeConn = nil
+	return conn, rep, nil
+}
+
+// dialProxy dials the proxy itself, via Forward if set.
+func (d *Client) dialProxy(ctx context.Context) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		var nd net.Dialer
+		return nd.DialContext(ctx, d.ProxyNetwork, d.ProxyAddress)
+	}
+	if cd, ok := forward.(interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}); ok {
+		return cd.DialContext(ctx, d.ProxyNetwork, d.ProxyAddress)
+	}
+	return forward.Dial(d.ProxyNetwork, d.ProxyAddress)
+}
+
+// negotiate performs socks5 method negotiation and, if necessary,
+// authentication, against a freshly-dialed conn.
+func (d *Client) negotiate(ctx context.Context, conn net.Conn) error {
+	methods := d.AuthMethods
+	if len(methods) == 0 {
+		methods = []byte{NO_AUTH_REQUIRED}
+	}
+	req := make([]byte, 0, 2+len(methods))
+	req = append(req, VER, byte(len(methods)))
+	req = append(req, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != VER {
+		return BadVer
+	}
+	method := reply[1]
+	if method == NO_ACCEPTABLE_METHODS {
+		return errors.New("socks5: proxy did not accept any offered authentication method")
+	}
+	if method == NO_AUTH_REQUIRED {
+		return nil
+	}
+	if d.Authenticate == nil {
+		return errors.New("socks5: proxy selected an authentication method but Client.Authenticate is nil")
+	}
+	return d.Authenticate(ctx, conn, method)
+}
+
+// watchContext arranges for conn's deadline to be forced into the past
+// when ctx is done, the standard trick for making a blocking conn
+// operation respect context cancellation. The returned func must be
+// called to stop the watcher once the operation is complete.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// readMsgCtx reads a Msg from conn, honoring ctx's cancellation via
+// watchContext.
+func readMsgCtx(ctx context.Context, conn net.Conn) (*Msg, error) {
+	stop := watchContext(ctx, conn)
+	defer stop()
+	rep := &Msg{}
+	if _, err := rep.ReadFrom(conn); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rep, nil
+}
+
+// replyAddr reconstructs a net.Addr from a reply Msg's Addr/Port fields.
+func replyAddr(rep *Msg) net.Addr {
+	return &net.TCPAddr{IP: rep.Addr.IPAddr, Port: int(rep.Port)}
+}
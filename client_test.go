@@ -0,0 +1,207 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEchoListener starts a TCP listener that echoes back whatever it
+// reads, on every connection it accepts, until the listener is closed.
+func startEchoListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if n > 0 {
+						if _, werr := conn.Write(buf[:n]); werr != nil {
+							return
+						}
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func startSocksServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := &Server{Backend: PassThroughDialer}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func TestClientDialContextConnect(t *testing.T) {
+	upstream := startEchoListener(t)
+	proxyAddr := startSocksServer(t)
+
+	d := &Client{ProxyNetwork: "tcp", ProxyAddress: proxyAddr}
+	conn, err := d.DialContext(context.Background(), "tcp", upstream)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	want := []byte("hello through socks5")
+	if _, err := conn.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := readFull(conn, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("round trip = %q, want %q", got, want)
+	}
+}
+
+func TestClientBind(t *testing.T) {
+	proxyAddr := startSocksServer(t)
+
+	d := &Client{ProxyNetwork: "tcp", ProxyAddress: proxyAddr}
+	bound, err := d.Bind(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+
+	peerDone := make(chan struct{})
+	go func() {
+		defer close(peerDone)
+		peer, err := net.Dial("tcp", bound.Addr.String())
+		if err != nil {
+			t.Errorf("peer Dial: %v", err)
+			return
+		}
+		defer peer.Close()
+		peer.Write([]byte("ping"))
+	}()
+
+	conn, err := bound.Accept(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+
+	got := make([]byte, 4)
+	if _, err := readFull(conn, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("Read = %q, want %q", got, "ping")
+	}
+	<-peerDone
+}
+
+func TestClientUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	proxyAddr := startSocksServer(t)
+	d := &Client{ProxyNetwork: "tcp", ProxyAddress: proxyAddr}
+	pc, err := d.UDPAssociate(context.Background(), "udp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("UDPAssociate: %v", err)
+	}
+	defer pc.Close()
+
+	want := []byte("ping")
+	if _, err := pc.WriteTo(want, echo.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, 4096)
+	n, _, err := pc.ReadFrom(got)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if string(got[:n]) != string(want) {
+		t.Errorf("round trip = %q, want %q", got[:n], want)
+	}
+}
+
+// startStallingListener starts a listener that accepts connections but
+// never writes anything to them, so a client stuck negotiating against it hangs until something
+// external (like context cancellation) intervenes.
+func startStallingListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn // deliberately never read from or written to
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClientDialContextHonorsCancellation(t *testing.T) {
+	proxyAddr := startStallingListener(t)
+	d := &Client{ProxyNetwork: "tcp", ProxyAddress: proxyAddr}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := d.DialContext(ctx, "tcp", "example.com:80")
+	if err == nil {
+		t.Fatal("DialContext succeeded against a stalling proxy, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("DialContext took %v to respect ctx cancellation, want well under 2s", elapsed)
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strconv"
 )
 
 const (
@@ -41,10 +42,11 @@ const (
 
 var (
 	// Marshalling related errors
-	BadVer  = errors.New("Unexpected version number (expected 5)")
-	BadRsv  = errors.New("Reserved field was not zero.")
-	BadAtyp = errors.New("Unsupported address address type")
-	BadStr  = errors.New("String too long (max 255 chars)")
+	BadVer        = errors.New("Unexpected version number (expected 5)")
+	BadRsv        = errors.New("Reserved field was not zero.")
+	BadAtyp       = errors.New("Unsupported address address type")
+	BadStr        = errors.New("String too long (max 255 chars)")
+	BadDomainName = errors.New("Domain name length must be between 1 and 255 bytes")
 )
 
 // Returns an error code corresponding to the error "err". If err is of
@@ -86,12 +88,12 @@ func (a *Address) ReadFrom(r io.Reader) (n int64, err error) {
 	var buf []byte
 	var count int
 	readIp := func() {
-		count, err = r.Read(buf)
+		count, err = io.ReadFull(r, buf)
 		n += int64(count)
 		a.IPAddr = buf
 	}
 	buf = []byte{0}
-	count, err = r.Read(buf)
+	count, err = io.ReadFull(r, buf)
 	n += int64(count)
 	if err != nil {
 		return
@@ -106,14 +108,20 @@ func (a *Address) ReadFrom(r io.Reader) (n int64, err error) {
 		readIp()
 	case ATYP_DOMAINNAME:
 		buf = []byte{0}
-		count, err = r.Read(buf)
+		count, err = io.ReadFull(r, buf)
 		n += int64(count)
 		if err != nil {
 			return
 		}
 		name_len := buf[0]
+		// RFC 1928 allows 1-255 bytes for the domain name; since
+		// name_len is a byte, the upper bound is automatic, but a
+		// length of zero is never valid.
+		if name_len == 0 {
+			return n, BadDomainName
+		}
 		buf = make([]byte, name_len)
-		count, err = r.Read(buf)
+		count, err = io.ReadFull(r, buf)
 		n += int64(count)
 		if err != nil {
 			return
@@ -163,7 +171,7 @@ type Msg struct {
 func (m *Msg) ReadFrom(r io.Reader) (n int64, err error) {
 	var count int
 	buf := make([]byte, 3)
-	count, err = r.Read(buf)
+	count, err = io.ReadFull(r, buf)
 	n += int64(count)
 	if err != nil {
 		return
@@ -182,7 +190,7 @@ func (m *Msg) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 
 	buf = make([]byte, 2)
-	count, err = r.Read(buf)
+	count, err = io.ReadFull(r, buf)
 	n += int64(count)
 	if err != nil {
 		return
@@ -206,11 +214,96 @@ func (m *Msg) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// hostPortAddress splits "host:port" (as produced by net.JoinHostPort) into
+// an Address and a port, choosing ATYP_IPV4/ATYP_IPV6/ATYP_DOMAINNAME as
+// appropriate for host.
+func hostPortAddress(hostport string) (Address, uint16, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return Address{}, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Address{}, 0, err
+	}
+	return addrFromHost(host), uint16(port), nil
+}
+
+// addrFromHost builds an Address for host, which may be a literal IPv4 or
+// IPv6 address or a domain name.
+func addrFromHost(host string) Address {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return Address{Atyp: ATYP_IPV4, IPAddr: ip4}
+		}
+		return Address{Atyp: ATYP_IPV6, IPAddr: ip}
+	}
+	return Address{Atyp: ATYP_DOMAINNAME, DomainName: host}
+}
+
+// udpHeader is the header prepended to each UDP datagram relayed under a
+// UDP ASSOCIATE, as described by RFC 1928 section 7:
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV |FRAG  | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+//
+// Fragmentation (FRAG != 0) is not implemented; datagrams with a nonzero
+// FRAG are rejected.
+type udpHeader struct {
+	Frag byte
+	Addr Address
+	Port uint16
+}
+
+func (h *udpHeader) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, 3)
+	var count int
+	count, err = io.ReadFull(r, buf)
+	n += int64(count)
+	if err != nil {
+		return
+	}
+	if buf[0] != 0 || buf[1] != 0 {
+		return n, BadRsv
+	}
+	h.Frag = buf[2]
+	count2, err := h.Addr.ReadFrom(r)
+	n += count2
+	if err != nil {
+		return
+	}
+	buf = make([]byte, 2)
+	count, err = io.ReadFull(r, buf)
+	n += int64(count)
+	if err != nil {
+		return
+	}
+	h.Port = binary.BigEndian.Uint16(buf)
+	return
+}
+
+func (h *udpHeader) WriteTo(w io.Writer) (n int64, err error) {
+	write := func(p []byte) { writeHelper(&n, &err, w, p) }
+	write([]byte{0, 0, h.Frag})
+	count, err := h.Addr.WriteTo(w)
+	n += count
+	if err != nil {
+		return
+	}
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, h.Port)
+	write(port)
+	return
+}
+
 // An error representable in the socks 5 protocol's reply field
 type ReplyCode byte
 
 func (c ReplyCode) Error() string {
-	return []string{
+	names := []string{
 		"success",
 		"general server failure",
 		"connection not allowed",
@@ -220,5 +313,9 @@ func (c ReplyCode) Error() string {
 		"ttl expired",
 		"command not supported",
 		"address type not supported",
-	}[c]
+	}
+	if int(c) >= len(names) {
+		return "unknown reply code " + strconv.Itoa(int(c))
+	}
+	return names[c]
 }
@@ -0,0 +1,63 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAddressRoundTripOneByteAtATime(t *testing.T) {
+	cases := []Address{
+		{Atyp: ATYP_IPV4, IPAddr: net.IPv4(127, 0, 0, 1).To4()},
+		{Atyp: ATYP_IPV6, IPAddr: net.ParseIP("::1")},
+		{Atyp: ATYP_DOMAINNAME, DomainName: "example.com"},
+		{Atyp: ATYP_DOMAINNAME, DomainName: strings.Repeat("x", 255)},
+	}
+	for _, want := range cases {
+		var buf bytes.Buffer
+		if _, err := want.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo(%+v): %v", want, err)
+		}
+
+		var got Address
+		r := iotest.OneByteReader(bytes.NewReader(buf.Bytes()))
+		if _, err := got.ReadFrom(r); err != nil {
+			t.Fatalf("ReadFrom(%+v): %v", want, err)
+		}
+		if got.Atyp != want.Atyp || got.String() != want.String() {
+			t.Errorf("round trip mismatch: got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestAddressZeroLengthDomainName(t *testing.T) {
+	buf := []byte{ATYP_DOMAINNAME, 0}
+	var a Address
+	_, err := a.ReadFrom(bytes.NewReader(buf))
+	if err != BadDomainName {
+		t.Errorf("ReadFrom(zero-length domain name) = %v, want BadDomainName", err)
+	}
+}
+
+func TestMsgRoundTripOneByteAtATime(t *testing.T) {
+	want := &Msg{
+		Code: REQ_CONNECT,
+		Addr: Address{Atyp: ATYP_DOMAINNAME, DomainName: "example.com"},
+		Port: 443,
+	}
+	var buf bytes.Buffer
+	if _, err := want.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	got := &Msg{}
+	r := iotest.OneByteReader(bytes.NewReader(buf.Bytes()))
+	if _, err := got.ReadFrom(r); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if got.Code != want.Code || got.Addr.String() != want.Addr.String() || got.Port != want.Port {
+		t.Errorf("round trip mismatch: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+)
+
+// PerHost is a Dialer that routes each request between two other Dialers
+// based on the destination host: requests matching a rule added via
+// AddHost, AddIP, AddNetwork, AddZone, or parsed by AddFromString go to
+// Bypass; everything else goes to Default.
+//
+// Since PerHost implements Dial, it also satisfies Backend, so a
+// *PerHost can be passed directly to ListenAndServe to run a proxy that
+// forwards some traffic upstream (for instance to a Tor socks5 proxy
+// reached via a client Dialer) and dials the rest directly.
+type PerHost struct {
+	Default Dialer
+	Bypass  Dialer
+
+	bypassHosts    map[string]bool
+	bypassZones    []string
+	bypassIPs      []net.IP
+	bypassNetworks []*net.IPNet
+}
+
+// NewPerHost returns a PerHost that sends requests to bypass if they
+// match a rule added via AddFromString/AddHost/AddIP/AddNetwork/AddZone,
+// and to def otherwise.
+func NewPerHost(def, bypass Dialer) *PerHost {
+	return &PerHost{Default: def, Bypass: bypass}
+}
+
+// Dial dials addr using either Default or Bypass, as determined by the
+// rules registered on p.
+func (p *PerHost) Dial(network, addr string) (net.Conn, error) {
+	return p.dialerForRequest(addr).Dial(network, addr)
+}
+
+func (p *PerHost) dialerForRequest(addr string) Dialer {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, net := range p.bypassNetworks {
+			if net.Contains(ip) {
+				return p.Bypass
+			}
+		}
+		for _, bypassIP := range p.bypassIPs {
+			if bypassIP.Equal(ip) {
+				return p.Bypass
+			}
+		}
+		return p.Default
+	}
+
+	host = strings.TrimSuffix(host, ".")
+
+	if p.bypassHosts[host] {
+		return p.Bypass
+	}
+	for _, zone := range p.bypassZones {
+		if strings.HasSuffix(host, zone) {
+			return p.Bypass
+		}
+		if host == zone[1:] {
+			return p.Bypass
+		}
+	}
+	return p.Default
+}
+
+// AddFromString parses a comma-separated list of rules, in any
+// combination accepted by AddHost/AddIP/AddNetwork/AddZone: an entry
+// containing "/" is a CIDR network, one starting with "." or "*." is a
+// DNS suffix zone, one parseable by net.ParseIP is a literal IP, and
+// anything else is a literal hostname. Malformed entries are silently
+// skipped.
+func (p *PerHost) AddFromString(s string) {
+	for _, host := range strings.Split(s, ",") {
+		host = strings.TrimSpace(host)
+		if len(host) == 0 {
+			continue
+		}
+		switch {
+		case strings.Contains(host, "/"):
+			if _, net, err := net.ParseCIDR(host); err == nil {
+				p.AddNetwork(net)
+			}
+		case host[0] == '.':
+			p.AddZone(host)
+		case strings.HasPrefix(host, "*."):
+			p.AddZone(host[1:])
+		default:
+			if ip := net.ParseIP(host); ip != nil {
+				p.AddIP(ip)
+			} else {
+				p.AddHost(host)
+			}
+		}
+	}
+}
+
+// AddHost bypasses requests for the literal hostname host (a trailing
+// dot, if any, is ignored).
+func (p *PerHost) AddHost(host string) *PerHost {
+	host = strings.TrimSuffix(host, ".")
+	if p.bypassHosts == nil {
+		p.bypassHosts = make(map[string]bool)
+	}
+	p.bypassHosts[host] = true
+	return p
+}
+
+// AddIP bypasses requests for the literal IP ip.
+func (p *PerHost) AddIP(ip net.IP) *PerHost {
+	p.bypassIPs = append(p.bypassIPs, ip)
+	return p
+}
+
+// AddNetwork bypasses requests for any IP contained in net.
+func (p *PerHost) AddNetwork(network *net.IPNet) *PerHost {
+	p.bypassNetworks = append(p.bypassNetworks, network)
+	return p
+}
+
+// AddZone bypasses requests for any hostname in the DNS zone zone, for
+// instance ".example.com" (or, equivalently, "example.com").
+func (p *PerHost) AddZone(zone string) *PerHost {
+	zone = strings.TrimSuffix(zone, ".")
+	if !strings.HasPrefix(zone, ".") {
+		zone = "." + zone
+	}
+	p.bypassZones = append(p.bypassZones, zone)
+	return p
+}
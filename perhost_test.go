@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+type recordingDialer struct {
+	name string
+}
+
+func (d *recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, errors.New(d.name)
+}
+
+func TestPerHostDialerForRequest(t *testing.T) {
+	def := &recordingDialer{name: "default"}
+	bypass := &recordingDialer{name: "bypass"}
+
+	p := NewPerHost(def, bypass)
+	p.AddHost("example.com")
+	p.AddZone(".internal")
+	p.AddIP(net.ParseIP("203.0.113.7"))
+	p.AddNetwork(mustParseCIDR(t, "10.0.0.0/8"))
+	p.AddNetwork(mustParseCIDR(t, "fd00::/8"))
+
+	cases := []struct {
+		addr string
+		want *recordingDialer
+	}{
+		{"example.com:80", bypass},
+		{"example.com.:80", bypass}, // trailing dot is ignored
+		{"other.com:80", def},
+		{"host.internal:80", bypass},
+		{"internal:80", bypass}, // exact zone match, no subdomain
+		{"sub.host.internal:80", bypass},
+		{"notinternal:80", def},
+		{"203.0.113.7:80", bypass},
+		{"203.0.113.8:80", def},
+		{"10.1.2.3:80", bypass},
+		{"11.1.2.3:80", def},
+		{"[fd00::1]:80", bypass},
+		{"[fe00::1]:80", def},
+	}
+	for _, c := range cases {
+		got := p.dialerForRequest(c.addr)
+		if got != c.want {
+			t.Errorf("dialerForRequest(%q) = %v, want %v", c.addr, got.(*recordingDialer).name, c.want.name)
+		}
+	}
+}
+
+func TestPerHostAddFromString(t *testing.T) {
+	def := &recordingDialer{name: "default"}
+	bypass := &recordingDialer{name: "bypass"}
+
+	p := NewPerHost(def, bypass)
+	p.AddFromString("10.0.0.0/8, *.corp.example ,localhost,203.0.113.7,not a valid/ cidr")
+
+	cases := []struct {
+		addr string
+		want *recordingDialer
+	}{
+		{"10.1.1.1:80", bypass},
+		{"www.corp.example:80", bypass},
+		{"corp.example:80", bypass},
+		{"localhost:80", bypass},
+		{"203.0.113.7:80", bypass},
+		{"example.com:80", def},
+	}
+	for _, c := range cases {
+		got := p.dialerForRequest(c.addr)
+		if got != c.want {
+			t.Errorf("dialerForRequest(%q) = %v, want %v", c.addr, got.(*recordingDialer).name, c.want.name)
+		}
+	}
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return network
+}
@@ -0,0 +1,38 @@
+package socks5
+
+import (
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	proxy.RegisterDialerType("socks5", FromURL)
+	proxy.RegisterDialerType("socks5h", FromURL)
+}
+
+// FromURL builds a Client from a socks5:// or socks5h:// URL, for use
+// with golang.org/x/net/proxy.FromURL and proxy.RegisterDialerType.
+// Since Client.Dial never resolves the destination host itself -- it
+// always hands the hostname to the proxy and lets it resolve -- the two
+// schemes are handled identically.
+//
+// If u has userinfo, it is used as a username/password pair offered via
+// UserPassAuthenticate. forward is used to reach the proxy itself.
+//
+// Client also implements proxy.ContextDialer (via DialContext), so
+// proxy.Dial(ctx, ...) works without a goroutine detour.
+func FromURL(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &Client{
+		ProxyNetwork: "tcp",
+		ProxyAddress: u.Host,
+		Forward:      forward,
+	}
+	if u.User != nil {
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		d.AuthMethods = []byte{USERNAME_PASSWORD}
+		d.Authenticate = UserPassAuthenticate(user, pass)
+	}
+	return d, nil
+}
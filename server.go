@@ -1,24 +1,31 @@
-// Package socks5 implements message marshalling and a server for the
-// socks 5 protocol (RFC 1928).
+// Package socks5 implements message marshalling, a client, and a server
+// for the socks 5 protocol (RFC 1928).
 //
-// So far, only the CONNECT request is supported, and only the "No
-// authentication required" method is supported for authentication.
-//
-// The Server interface is defined to allow different backends to be
+// The Backend interface is defined to allow different backends to be
 // used for establishing connections. Users interested primarily in
-// writing servers need only concern themselves with that interface,
-// and the functions Serve/ListenAndServe.
+// writing servers need only concern themselves with that interface, and
+// the Server type. A Backend that also implements Binder and/or
+// PacketBinder additionally supports the BIND and UDP ASSOCIATE
+// commands; otherwise only CONNECT is available. A Backend that
+// implements AuthenticatorProvider can require authentication (see
+// Authenticator); by default NO_AUTH_REQUIRED is the only accepted
+// method.
 //
 // The message marshalling is also exposed, in the hopes that it may be
 // useful.
 package socks5 // import "zenhack.net/go/socks5"
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // The Dialer interface provides the ability to establish network
@@ -28,133 +35,546 @@ type Dialer interface {
 	Dial(network, addr string) (c net.Conn, err error)
 }
 
-// A server handles socks requests. Right now this is equivalent to a
-// Dialer; in the future more methods may be needed to support requests
-// other than CONNECT.
-type Server interface {
+// A Backend handles socks requests. At minimum this is equivalent to a
+// Dialer, which is enough to support the CONNECT command; a Backend may
+// also implement Binder and/or PacketBinder to support BIND and UDP
+// ASSOCIATE respectively.
+type Backend interface {
 	Dialer
 }
 
-// Listen on the address addr and then accept connections, as with
-// the Serve function.
-func ListenAndServe(s Server, addr string) error {
-	listener, err := net.Listen("tcp", addr)
+// Binder is implemented by Backends that support the socks5 BIND
+// command. Listen should behave like the net package's Listen function.
+type Binder interface {
+	Listen(network, addr string) (net.Listener, error)
+}
+
+// PacketBinder is implemented by Backends that support the socks5 UDP
+// ASSOCIATE command. ListenPacket should behave like the net package's
+// ListenPacket function.
+type PacketBinder interface {
+	ListenPacket(network, addr string) (net.PacketConn, error)
+}
+
+// ContextDialer is implemented by Backends that want the AuthContext
+// produced by authentication (see AuthContextFromContext), along with
+// general request cancellation, threaded through to the dial. If a
+// Backend implements it, handleConn calls DialContext instead of Dial
+// for CONNECT requests.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Server serves socks5 connections, dispatching requests to Backend. The
+// zero value is not usable; Backend must be set.
+type Server struct {
+	// Backend handles requests once they've been accepted and
+	// authenticated.
+	Backend Backend
+
+	// Logger is used to report per-connection errors. If nil, the
+	// standard log package's default logger is used. Errors concerning
+	// individual UDP ASSOCIATE datagrams always go to the standard
+	// log package's default logger.
+	Logger *log.Logger
+
+	// BaseContext, if non-nil, supplies the base context for each
+	// connection accepted by l; it is called once per call to Serve.
+	// If nil, context.Background() is used.
+	BaseContext func(l net.Listener) context.Context
+
+	// ConnContext, if non-nil, is called to derive a per-connection
+	// context from the base context and the just-accepted conn, before
+	// any authentication or request parsing happens.
+	ConnContext func(ctx context.Context, conn net.Conn) context.Context
+
+	// ReadTimeout and WriteTimeout bound the method negotiation,
+	// authentication, reading of the request, and the reply to a
+	// request rejected by OnRequest. They are cleared before a request
+	// is dispatched, so they do not apply to the Backend's dial, the
+	// reply to a dispatched request, or the relay that follows. IdleTimeout
+	// bounds how long a relay may go without transferring data. Zero
+	// means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// OnConnect, if non-nil, is called once per accepted connection,
+	// before authentication.
+	OnConnect func(ctx context.Context, conn net.Conn)
+
+	// OnRequest, if non-nil, is called after a request has been parsed
+	// and before it is dispatched to Backend. Returning a non-nil error
+	// rejects the request; if the error is a ReplyCode, that code is
+	// sent back to the client, otherwise REP_GENERAL_SERVER_FAILURE is.
+	OnRequest func(ctx context.Context, req *Msg) error
+
+	// OnClose, if non-nil, is called once a CONNECT or BIND relay has
+	// finished, with the number of bytes copied in each direction. It is
+	// not called for UDP ASSOCIATE requests, nor for requests that fail
+	// before a relay starts.
+	OnClose func(ctx context.Context, bytesUp, bytesDown int64)
+
+	mu       sync.Mutex
+	listener net.Listener
+	closers  map[io.Closer]struct{}
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+// ListenAndServe listens on the tcp network address addr and then calls
+// Serve to handle incoming connections.
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	return Serve(s, listener)
+	return srv.Serve(l)
 }
 
-// Accept connections via l and, invoke the server s to handle them.
-// Spawn a new goroutine for each request.
-func Serve(s Server, l net.Listener) error {
+// Serve accepts connections on l, spawning a goroutine to handle each
+// one, until l.Accept fails or Close/Shutdown is called.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	srv.listener = l
+	if srv.closers == nil {
+		srv.closers = make(map[io.Closer]struct{})
+	}
+	srv.mu.Unlock()
+
+	baseCtx := context.Background()
+	if srv.BaseContext != nil {
+		baseCtx = srv.BaseContext(l)
+	}
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return nil
+			}
 			return err
 		}
-		go handleConn(s, conn)
+
+		ctx := baseCtx
+		if srv.ConnContext != nil {
+			ctx = srv.ConnContext(ctx, conn)
+		}
+
+		srv.trackCloser(conn, true)
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			defer srv.trackCloser(conn, false)
+			srv.handleConn(ctx, conn)
+		}()
 	}
 }
 
-// Build a reply message based on err and the information provided by
-// `conn`. `conn` may be nil if err is non-nil.
-func makeReply(conn net.Conn, err error) *Msg {
-	if err != nil {
-		return &Msg{Code: ReplyError(err)}
+// Close closes srv's listener and any connections, BIND listeners, and
+// UDP ASSOCIATE packet conns it has accepted or opened, without waiting
+// for in-flight requests to finish.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	l := srv.listener
+	closers := make([]io.Closer, 0, len(srv.closers))
+	for c := range srv.closers {
+		closers = append(closers, c)
 	}
+	srv.mu.Unlock()
 
-	addrStr := conn.LocalAddr().String()
-	// The contract of conn.LocalAddr().String() requires that addrStr
-	// is valid, therefore we can neglect the possibility of parse errors
-	// in the below:
-	hostStr, portStr, _ := net.SplitHostPort(addrStr)
-	port, _ := strconv.Atoi(portStr)
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	for _, c := range closers {
+		c.Close()
+	}
+	return err
+}
 
-	rep := &Msg{
-		Code: byte(REP_SUCCESS),
-		Port: uint16(port),
+// Shutdown closes srv's listener, so that it stops accepting new
+// connections, then waits for in-flight requests to finish, bounded by
+// ctx.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closed = true
+	l := srv.listener
+	srv.mu.Unlock()
+	if l != nil {
+		l.Close()
 	}
-	rep.Addr.IPAddr = net.ParseIP(hostStr)
-	if rep.Addr.IPAddr == nil {
-		rep.Addr = Address{
-			Atyp:       ATYP_DOMAINNAME,
-			DomainName: hostStr,
-		}
-	} else if len(rep.Addr.IPAddr) == 4 {
-		rep.Addr.Atyp = ATYP_IPV4
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackCloser registers (or, if add is false, unregisters) c so that
+// Close can close it even while it's otherwise idle (blocked in Accept,
+// relaying data, etc.).
+func (srv *Server) trackCloser(c io.Closer, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		srv.closers[c] = struct{}{}
 	} else {
-		rep.Addr.Atyp = ATYP_IPV6
+		delete(srv.closers, c)
+	}
+}
+
+// logPrintln logs via srv.Logger if set, or the standard logger
+// otherwise.
+func (srv *Server) logPrintln(v ...interface{}) {
+	if srv.Logger != nil {
+		srv.Logger.Println(v...)
+		return
+	}
+	log.Println(v...)
+}
+
+// ListenAndServe listens on the address addr and then accepts
+// connections as with Serve. It is provided for backward compatibility;
+// new code should construct a *Server.
+func ListenAndServe(b Backend, addr string) error {
+	return (&Server{Backend: b}).ListenAndServe(addr)
+}
+
+// Serve accepts connections via l and dispatches them to b. It is
+// provided for backward compatibility; new code should construct a
+// *Server.
+func Serve(b Backend, l net.Listener) error {
+	return (&Server{Backend: b}).Serve(l)
+}
+
+// errReply builds a reply message reporting err, which must be non-nil.
+func errReply(err error) *Msg {
+	return &Msg{Code: ReplyError(err)}
+}
+
+// addrReply builds a successful reply message reporting addr.
+func addrReply(addr net.Addr) *Msg {
+	// The contract of addr.String() requires that it is valid,
+	// therefore we can neglect the possibility of parse errors below:
+	host, port, _ := hostPortAddress(addr.String())
+	return &Msg{Code: byte(REP_SUCCESS), Addr: host, Port: port}
+}
+
+// Build a reply message based on err and the information provided by
+// `conn`. `conn` may be nil if err is non-nil.
+func makeReply(conn net.Conn, err error) *Msg {
+	if err != nil {
+		return errReply(err)
 	}
-	return rep
+	return addrReply(conn.LocalAddr())
 }
 
-// Copy data between a and b (both ways) concurrently.
-func doCopy(a, b io.ReadWriter) {
-	done := make(chan byte)
+// Copy data between conn and socksConn (both ways) concurrently,
+// returning the number of bytes copied conn->socksConn (up) and
+// socksConn->conn (down) once both directions have finished.
+func doCopy(conn, socksConn io.ReadWriter) (up, down int64) {
+	downCh := make(chan int64)
 	go func() {
-		io.Copy(a, b)
-		done <- 0
+		n, _ := io.Copy(conn, socksConn)
+		downCh <- n
 	}()
-	io.Copy(b, a)
-	<-done
+	up, _ = io.Copy(socksConn, conn)
+	down = <-downCh
+	return up, down
 }
 
-// Handle the socks connection conn using the server s
-func handleConn(s Server, conn net.Conn) {
-	err := authConn(conn)
+// handleConn handles the socks connection conn, using srv.Backend.
+func (srv *Server) handleConn(ctx context.Context, conn net.Conn) {
+	if srv.OnConnect != nil {
+		srv.OnConnect(ctx, conn)
+	}
+
+	srv.setDeadline(conn, srv.ReadTimeout, srv.WriteTimeout)
+	authCtx, err := authConn(srv.Backend, conn)
 	if err != nil {
-		log.Println("Error authenticating client: ", err)
+		srv.logPrintln("Error authenticating client: ", err)
 		return
 	}
 	req := &Msg{}
 	_, err = req.ReadFrom(conn)
 	if err != nil {
-		log.Println("Error reading request: ", err)
+		srv.logPrintln("Error reading request: ", err)
 		return
 	}
+	ctx = withAuthContext(ctx, authCtx)
+
+	if srv.OnRequest != nil {
+		if err := srv.OnRequest(ctx, req); err != nil {
+			(&Msg{Code: ReplyError(err)}).WriteTo(conn)
+			srv.logPrintln("Request rejected by OnRequest: ", err)
+			return
+		}
+	}
+
+	srv.setDeadline(conn, 0, 0)
 	switch req.Code {
 	case REQ_CONNECT:
-		socksConn, err := s.Dial("tcp", net.JoinHostPort(
-			req.Addr.String(),
-			strconv.Itoa(int(req.Port)),
-		))
-		rep := makeReply(socksConn, err)
-		rep.WriteTo(conn)
+		srv.handleConnect(ctx, conn, req)
+	case REQ_BIND:
+		srv.handleBind(ctx, conn, req)
+	case REQ_UDP_ASSOCIATE:
+		srv.handleUDPAssociate(ctx, conn, req)
+	default:
+		(&Msg{Code: byte(REP_CMD_NOT_SUPPORTED)}).WriteTo(conn)
+		srv.logPrintln("Command not supported: ", req.Code)
+	}
+}
+
+func (srv *Server) setDeadline(conn net.Conn, read, write time.Duration) {
+	if read > 0 {
+		conn.SetReadDeadline(time.Now().Add(read))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+	if write > 0 {
+		conn.SetWriteDeadline(time.Now().Add(write))
+	} else {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// handleConnect services a CONNECT request by dialing the requested
+// address via srv.Backend and relaying data between conn and the
+// resulting connection. If the backend implements ContextDialer, ctx
+// (which carries the AuthContext from authentication) is threaded
+// through to the dial.
+func (srv *Server) handleConnect(ctx context.Context, conn net.Conn, req *Msg) {
+	dst := net.JoinHostPort(req.Addr.String(), strconv.Itoa(int(req.Port)))
+	var socksConn net.Conn
+	var err error
+	if cd, ok := srv.Backend.(ContextDialer); ok {
+		socksConn, err = cd.DialContext(ctx, "tcp", dst)
+	} else {
+		socksConn, err = srv.Backend.Dial("tcp", dst)
+	}
+	rep := makeReply(socksConn, err)
+	rep.WriteTo(conn)
+	if err != nil {
+		srv.logPrintln("Error handling request: ", err)
+		return
+	}
+	if srv.IdleTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.IdleTimeout))
+		socksConn.SetDeadline(time.Now().Add(srv.IdleTimeout))
+	}
+	up, down := doCopy(conn, socksConn)
+	conn.Close()
+	socksConn.Close()
+	if srv.OnClose != nil {
+		srv.OnClose(ctx, up, down)
+	}
+}
+
+// handleBind services a BIND request. If srv.Backend does not implement
+// Binder, the request is rejected.
+func (srv *Server) handleBind(ctx context.Context, conn net.Conn, req *Msg) {
+	binder, ok := srv.Backend.(Binder)
+	if !ok {
+		(&Msg{Code: byte(REP_CMD_NOT_SUPPORTED)}).WriteTo(conn)
+		srv.logPrintln("Backend does not support BIND")
+		return
+	}
+	l, err := binder.Listen("tcp", ":0")
+	if err != nil {
+		errReply(err).WriteTo(conn)
+		srv.logPrintln("Error listening for BIND: ", err)
+		return
+	}
+	defer l.Close()
+	srv.trackCloser(l, true)
+	defer srv.trackCloser(l, false)
+	if _, err := addrReply(l.Addr()).WriteTo(conn); err != nil {
+		srv.logPrintln("Error sending BIND reply: ", err)
+		return
+	}
+	peer, err := l.Accept()
+	if err != nil {
+		errReply(err).WriteTo(conn)
+		srv.logPrintln("Error accepting BIND peer: ", err)
+		return
+	}
+	srv.trackCloser(peer, true)
+	defer srv.trackCloser(peer, false)
+	addrReply(peer.RemoteAddr()).WriteTo(conn)
+	if srv.IdleTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(srv.IdleTimeout))
+		peer.SetDeadline(time.Now().Add(srv.IdleTimeout))
+	}
+	up, down := doCopy(conn, peer)
+	conn.Close()
+	peer.Close()
+	if srv.OnClose != nil {
+		srv.OnClose(ctx, up, down)
+	}
+}
+
+// handleUDPAssociate services a UDP ASSOCIATE request. If srv.Backend
+// does not implement PacketBinder, the request is rejected. The
+// association is torn down once conn (the TCP control connection) is
+// closed.
+func (srv *Server) handleUDPAssociate(ctx context.Context, conn net.Conn, req *Msg) {
+	binder, ok := srv.Backend.(PacketBinder)
+	if !ok {
+		(&Msg{Code: byte(REP_CMD_NOT_SUPPORTED)}).WriteTo(conn)
+		srv.logPrintln("Backend does not support UDP ASSOCIATE")
+		return
+	}
+	pc, err := binder.ListenPacket("udp", ":0")
+	if err != nil {
+		errReply(err).WriteTo(conn)
+		srv.logPrintln("Error listening for UDP ASSOCIATE: ", err)
+		return
+	}
+	defer pc.Close()
+	if _, err := addrReply(pc.LocalAddr()).WriteTo(conn); err != nil {
+		srv.logPrintln("Error sending UDP ASSOCIATE reply: ", err)
+		return
+	}
+
+	// The association lives as long as the control connection does;
+	// once it's closed (or errors), tear down the relay.
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		pc.Close()
+	}()
+
+	if srv.IdleTimeout > 0 {
+		pc.SetDeadline(time.Now().Add(srv.IdleTimeout))
+	}
+	relayUDP(pc)
+}
+
+// relayUDP services a UDP ASSOCIATE by shuttling datagrams between the
+// client (which speaks the framed protocol described by udpHeader) and
+// whatever destinations it asks to reach, until pc is closed.
+func relayUDP(pc net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
 		if err != nil {
-			log.Println("Error handling request: ", err)
 			return
 		}
-		doCopy(conn, socksConn)
-		conn.Close()
-		socksConn.Close()
-	default:
-		(&Msg{Code: byte(REP_CMD_NOT_SUPPORTED)}).WriteTo(conn)
-		log.Println("Command not supported: ", req.Code)
+		if client == nil {
+			client = from
+		}
+		if from.String() == client.String() {
+			relayClientDatagram(pc, buf[:n])
+		} else {
+			relayUpstreamDatagram(pc, client, from, buf[:n])
+		}
+	}
+}
+
+// relayClientDatagram forwards a datagram received from the client (still
+// bearing its udpHeader) on to its real destination.
+func relayClientDatagram(pc net.PacketConn, datagram []byte) {
+	hdr := udpHeader{}
+	r := bytes.NewReader(datagram)
+	if _, err := hdr.ReadFrom(r); err != nil {
+		log.Println("Error parsing UDP ASSOCIATE datagram: ", err)
+		return
+	}
+	if hdr.Frag != 0 {
+		log.Println("Dropping fragmented UDP ASSOCIATE datagram (unsupported)")
+		return
+	}
+	dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(
+		hdr.Addr.String(), strconv.Itoa(int(hdr.Port)),
+	))
+	if err != nil {
+		log.Println("Error resolving UDP ASSOCIATE destination: ", err)
+		return
 	}
+	payload := make([]byte, r.Len())
+	r.Read(payload)
+	pc.WriteTo(payload, dst)
 }
 
-// Do the authentication handshake. Right now we only support NO_AUTH_REQUIRED.
-func authConn(conn net.Conn) error {
+// relayUpstreamDatagram wraps a datagram received from some destination
+// in a udpHeader and forwards it to the client.
+func relayUpstreamDatagram(pc net.PacketConn, client, from net.Addr, payload []byte) {
+	host, port, err := hostPortAddress(from.String())
+	if err != nil {
+		log.Println("Error parsing UDP ASSOCIATE source address: ", err)
+		return
+	}
+	var buf bytes.Buffer
+	hdr := udpHeader{Addr: host, Port: port}
+	if _, err := hdr.WriteTo(&buf); err != nil {
+		log.Println("Error building UDP ASSOCIATE reply header: ", err)
+		return
+	}
+	buf.Write(payload)
+	pc.WriteTo(buf.Bytes(), client)
+}
+
+// Do the authentication handshake and method negotiation. If b
+// implements AuthenticatorProvider, the first method in the client's
+// offered list for which b has an Authenticator is used; otherwise, as
+// before, only NO_AUTH_REQUIRED is accepted.
+func authConn(b Backend, conn net.Conn) (AuthContext, error) {
 	buf := make([]byte, 255)
-	_, err := conn.Read(buf[:2])
+	_, err := io.ReadFull(conn, buf[:2])
 	if err != nil {
-		return err
+		return AuthContext{}, err
 	}
 	if buf[0] != VER {
-		return BadVer
+		return AuthContext{}, BadVer
 	}
 	nmethods := buf[1]
-	_, err = conn.Read(buf[:nmethods])
+	_, err = io.ReadFull(conn, buf[:nmethods])
 	if err != nil {
-		return err
+		return AuthContext{}, err
 	}
-	for i := range buf {
-		if buf[i] == NO_AUTH_REQUIRED {
-			_, err = conn.Write([]byte{VER, NO_AUTH_REQUIRED})
-			return err
+	offered := buf[:nmethods]
+
+	var authenticators []Authenticator
+	if p, ok := b.(AuthenticatorProvider); ok {
+		authenticators = p.Authenticators()
+	}
+	if len(authenticators) == 0 {
+		for _, m := range offered {
+			if m == NO_AUTH_REQUIRED {
+				_, err = conn.Write([]byte{VER, NO_AUTH_REQUIRED})
+				return AuthContext{Method: NO_AUTH_REQUIRED}, err
+			}
+		}
+		conn.Write([]byte{VER, NO_ACCEPTABLE_METHODS})
+		return AuthContext{}, errors.New("Client did not list NO_AUTH_REQUIRED as acceptable.")
+	}
+
+	byMethod := make(map[byte]Authenticator, len(authenticators))
+	for _, a := range authenticators {
+		byMethod[a.Method()] = a
+	}
+	for _, m := range offered {
+		a, ok := byMethod[m]
+		if !ok {
+			continue
+		}
+		if _, err := conn.Write([]byte{VER, m}); err != nil {
+			return AuthContext{}, err
 		}
+		return a.Authenticate(conn)
 	}
 	conn.Write([]byte{VER, NO_ACCEPTABLE_METHODS})
-	return errors.New("Client did not list NO_AUTH_REQUIRED as acceptable.")
+	return AuthContext{}, errors.New("Client did not offer an acceptable authentication method.")
 }
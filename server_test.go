@@ -0,0 +1,150 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUpstream starts a listener that accepts a single connection and
+// delivers it on the returned channel, without reading from or writing
+// to it. The caller is responsible for closing both the listener (via
+// t.Cleanup, already arranged) and the delivered connection.
+func startUpstream(t *testing.T) (addr string, accepted chan net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	accepted = make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String(), accepted
+}
+
+// dialThroughServer opens a CONNECT relay through srvAddr to upstream,
+// using the package's own client Dialer, and returns the resulting
+// connection.
+func dialThroughServer(t *testing.T, srvAddr, upstream string) net.Conn {
+	t.Helper()
+	d := &Client{ProxyNetwork: "tcp", ProxyAddress: srvAddr}
+	conn, err := d.DialContext(context.Background(), "tcp", upstream)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	return conn
+}
+
+func TestServerShutdownWaitsForInFlightConnection(t *testing.T) {
+	upstreamAddr, accepted := startUpstream(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := &Server{Backend: PassThroughDialer}
+	go srv.Serve(l)
+
+	client := dialThroughServer(t, l.Addr().String(), upstreamAddr)
+
+	var upstream net.Conn
+	select {
+	case upstream = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream never saw a connection")
+	}
+	defer upstream.Close()
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- srv.Shutdown(context.Background())
+	}()
+
+	// Shutdown must not return while the relay is still in flight.
+	select {
+	case err := <-shutdownDone:
+		t.Fatalf("Shutdown returned early (err=%v) before the in-flight connection closed", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// End the relay from both sides, as happens once client and
+	// backend are done talking to each other.
+	client.Close()
+	upstream.Close()
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after the in-flight connection closed")
+	}
+}
+
+func TestServerCloseDropsInFlightConnections(t *testing.T) {
+	upstreamAddr, accepted := startUpstream(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := &Server{Backend: PassThroughDialer}
+	go srv.Serve(l)
+
+	client := dialThroughServer(t, l.Addr().String(), upstreamAddr)
+	defer client.Close()
+
+	select {
+	case upstream := <-accepted:
+		defer upstream.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream never saw a connection")
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := client.Read(buf); err == nil {
+		t.Fatal("Read on client conn succeeded after Close, want it to have been dropped")
+	}
+}
+
+func TestServerCloseDropsPendingBindListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := &Server{Backend: PassThroughDialer}
+	go srv.Serve(l)
+
+	d := &Client{ProxyNetwork: "tcp", ProxyAddress: l.Addr().String()}
+	bound, err := d.Bind(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	bindAddr := bound.Addr.String()
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := net.Dial("tcp", bindAddr); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("BIND listener still accepting connections after Close")
+}
@@ -12,3 +12,11 @@ type passThroughDialer struct{}
 func (d passThroughDialer) Dial(network, addr string) (net.Conn, error) {
 	return net.Dial(network, addr)
 }
+
+func (d passThroughDialer) Listen(network, addr string) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
+
+func (d passThroughDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}